@@ -0,0 +1,133 @@
+package statemachine
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// errWriter collects the first write error encountered across a series of
+// Fprintf calls so export functions can read top to bottom without an
+// `if err != nil { return err }` after every line.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
+
+// stateLabel describes state for the graph exporters, annotating it with
+// whichever timeouts it configures.
+func stateLabel(state *State) []string {
+	lines := []string{state.ID}
+
+	if state.OnEnterTimeout > 0 {
+		lines = append(lines, fmt.Sprintf("OnEnterTimeout: %s", state.OnEnterTimeout))
+	}
+	if state.OnLeaveTimeout > 0 {
+		lines = append(lines, fmt.Sprintf("OnLeaveTimeout: %s", state.OnLeaveTimeout))
+	}
+	if state.StateTimeout > 0 {
+		lines = append(lines, fmt.Sprintf("StateTimeout: %s", state.StateTimeout))
+	}
+
+	return lines
+}
+
+// sortedStateIDs returns the registered state IDs in a deterministic
+// order, so exported graphs diff cleanly across runs.
+func (sm *StateMachine) sortedStateIDs() []string {
+	ids := make([]string, 0, len(sm.states))
+	for id := range sm.states {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// enterFromPredecessors returns the OnEnterFrom predecessor IDs of state,
+// sorted for deterministic output.
+func enterFromPredecessors(state *State) []string {
+	preds := make([]string, 0, len(state.OnEnterFrom))
+	for from := range state.OnEnterFrom {
+		preds = append(preds, from)
+	}
+	sort.Strings(preds)
+
+	return preds
+}
+
+// ExportDOT writes a Graphviz DOT rendering of the configured states to w:
+// one node per state (annotated with its timeouts), an edge for every
+// PossibleNextStates entry, a dashed edge from a substate to its Parent,
+// and an edge for every OnEnterFrom predecessor.
+func (sm *StateMachine) ExportDOT(w io.Writer) error {
+	ew := &errWriter{w: w}
+
+	ew.printf("digraph statemachine {\n")
+
+	ids := sm.sortedStateIDs()
+
+	for _, id := range ids {
+		label := strings.Join(stateLabel(sm.states[id]), "\\n")
+		ew.printf("  %q [label=\"%s\"];\n", id, label)
+	}
+
+	for _, id := range ids {
+		state := sm.states[id]
+
+		if state.Parent != NoState {
+			ew.printf("  %q -> %q [style=dashed, label=\"parent\"];\n", id, state.Parent)
+		}
+		for _, next := range state.PossibleNextStates {
+			ew.printf("  %q -> %q [label=\"selector\"];\n", id, next)
+		}
+		for _, from := range enterFromPredecessors(state) {
+			ew.printf("  %q -> %q [label=\"enter from %s\"];\n", from, id, from)
+		}
+	}
+
+	ew.printf("}\n")
+
+	return ew.err
+}
+
+// ExportMermaid writes a Mermaid stateDiagram-v2 rendering of the
+// configured states to w, using the same node and edge annotations as
+// ExportDOT.
+func (sm *StateMachine) ExportMermaid(w io.Writer) error {
+	ew := &errWriter{w: w}
+
+	ew.printf("stateDiagram-v2\n")
+
+	ids := sm.sortedStateIDs()
+
+	for _, id := range ids {
+		if label := stateLabel(sm.states[id]); len(label) > 1 {
+			ew.printf("  %s: %s\n", id, strings.Join(label[1:], "; "))
+		}
+	}
+
+	for _, id := range ids {
+		state := sm.states[id]
+
+		if state.Parent != NoState {
+			ew.printf("  %s --> %s: parent\n", id, state.Parent)
+		}
+		for _, next := range state.PossibleNextStates {
+			ew.printf("  %s --> %s: selector\n", id, next)
+		}
+		for _, from := range enterFromPredecessors(state) {
+			ew.printf("  %s --> %s: enter from %s\n", from, id, from)
+		}
+	}
+
+	return ew.err
+}
@@ -0,0 +1,68 @@
+package statemachine
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateMachineExportDOT(t *testing.T) {
+	sm := NewStateMachine()
+
+	sm.AddState(&State{
+		ID:                 "01",
+		StateTimeout:       time.Second,
+		PossibleNextStates: []string{"02"},
+	})
+	sm.AddState(&State{
+		ID: "02",
+		OnEnterFrom: map[string]StateEvent{
+			"01": nil,
+		},
+	})
+
+	var buf bytes.Buffer
+	if err := sm.ExportDOT(&buf); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		"digraph statemachine {",
+		`"01" [label="01\nStateTimeout: 1s"];`,
+		`"01" -> "02" [label="selector"];`,
+		`"01" -> "02" [label="enter from 01"];`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected DOT output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestStateMachineExportMermaid(t *testing.T) {
+	sm := NewStateMachine()
+
+	sm.AddState(&State{
+		ID:                 "01",
+		StateTimeout:       time.Second,
+		PossibleNextStates: []string{"02"},
+	})
+	sm.AddState(&State{ID: "02"})
+
+	var buf bytes.Buffer
+	if err := sm.ExportMermaid(&buf); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		"stateDiagram-v2",
+		"01: StateTimeout: 1s",
+		"01 --> 02: selector",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected Mermaid output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
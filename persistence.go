@@ -0,0 +1,236 @@
+package statemachine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNoSnapshot is returned by a Persister's Load when no snapshot has
+// been saved yet.
+var ErrNoSnapshot = errors.New("statemachine: no snapshot available")
+
+// ErrUnknownSnapshotState is returned by Resume when a loaded snapshot
+// names a state that isn't registered with the machine.
+var ErrUnknownSnapshotState = errors.New("statemachine: snapshot references an unknown state")
+
+// ErrNoPersister is returned by Resume when WithPersister was never
+// called.
+var ErrNoPersister = errors.New("statemachine: no persister configured")
+
+// Snapshot captures enough of a StateMachine's state to resume it later:
+// the current state, the per-state entry clocks, and a user-supplied
+// opaque payload.
+type Snapshot struct {
+	StateID   string
+	Clock     map[string]uint64
+	Data      interface{}
+	EnteredAt time.Time
+}
+
+// Persister saves and restores Snapshots, letting a long-running
+// StateMachine survive a process restart.
+type Persister interface {
+	Save(snapshot Snapshot) error
+	Load() (Snapshot, error)
+}
+
+// WithPersister configures p to receive a Snapshot after every successful
+// transition. Persistence happens asynchronously and never blocks or
+// fails the transition itself; a Save error is reported to the error
+// handler set via WithErrorHandler, if any.
+func (sm *StateMachine) WithPersister(p Persister) {
+	sm.persister = p
+}
+
+// SetSnapshotData sets the opaque payload included in every future
+// Snapshot, e.g. workflow-specific data the caller wants restored
+// alongside the current state on Resume. Like Start and Advance, the
+// write itself is applied on the dispatcher goroutine, since snapshotData
+// is also read from there by persistAsync.
+func (sm *StateMachine) SetSnapshotData(data interface{}) {
+	sm.dispatch(switchRequest{snapshotData: &data})
+}
+
+// persistAsync hands a Snapshot of the current state to the persist writer
+// goroutine, if a Persister is configured. Only ever called from the
+// dispatcher goroutine, so successive calls enqueue in transition order.
+func (sm *StateMachine) persistAsync() {
+	if sm.persister == nil {
+		return
+	}
+
+	current := sm.CurrentState()
+	if current == nil {
+		return
+	}
+
+	snapshot := Snapshot{
+		StateID:   current.ID,
+		Clock:     sm.Clocks(),
+		Data:      sm.snapshotData,
+		EnteredAt: time.Now(),
+	}
+
+	// persistRequests is buffered to size 1 and only ever holds the latest
+	// pending snapshot: if the writer hasn't drained the previous one yet,
+	// it is superseded here rather than queued behind it, so persistAsync
+	// never blocks the transition that called it. A single writer goroutine
+	// then applies whatever it reads to Save in the order it was enqueued,
+	// which is what stops an earlier transition's Save outrunning a later
+	// one's and clobbering it with a stale snapshot.
+	select {
+	case sm.persistRequests <- snapshot:
+	default:
+		select {
+		case <-sm.persistRequests:
+		default:
+		}
+		sm.persistRequests <- snapshot
+	}
+}
+
+// runPersistWriter drains persistRequests and saves each Snapshot with the
+// configured Persister, one at a time, until persistRequests is closed by
+// Stop. Started once, from NewStateMachine.
+func (sm *StateMachine) runPersistWriter() {
+	for snapshot := range sm.persistRequests {
+		if err := sm.persister.Save(snapshot); err != nil && sm.onError != nil {
+			sm.onError(err, EventState)
+		}
+	}
+}
+
+// Resume reloads the most recent Snapshot from the configured Persister
+// and sets the machine's current state to it directly, without firing
+// OnEnter. If the restored state has a StateTimeout, its watchdog is
+// reinstalled with whatever duration remains given the snapshot's
+// EnteredAt. Like Start and Advance, the restore itself is applied on the
+// dispatcher goroutine.
+func (sm *StateMachine) Resume() error {
+	if sm.persister == nil {
+		return ErrNoPersister
+	}
+
+	snapshot, err := sm.persister.Load()
+	if err != nil {
+		return err
+	}
+
+	return sm.dispatch(switchRequest{resume: &snapshot}).Err
+}
+
+// resumeFrom applies a loaded Snapshot. Only ever called from the
+// dispatcher goroutine via process.
+func (sm *StateMachine) resumeFrom(snapshot Snapshot) Result {
+	state, ok := sm.states[snapshot.StateID]
+	if !ok {
+		return Result{Err: ErrUnknownSnapshotState}
+	}
+
+	sm.cancelStateTimeout()
+	sm.current.Store(stateBox{state: state})
+	sm.snapshotData = snapshot.Data
+
+	sm.clockLock.Lock()
+	for id, tick := range snapshot.Clock {
+		sm.clock[id] = tick
+	}
+	sm.clockLock.Unlock()
+
+	remaining := state.StateTimeout
+	if state.StateTimeout > 0 && !snapshot.EnteredAt.IsZero() {
+		remaining = state.StateTimeout - time.Since(snapshot.EnteredAt)
+	}
+
+	sm.installStateTimeout(context.Background(), state, remaining)
+
+	return Result{Transitioned: true}
+}
+
+// MemoryPersister is an in-memory Persister. It doesn't survive a
+// process restart; it exists for tests and for callers that only need
+// Resume across a machine's own lifetime (e.g. failover between
+// StateMachine instances within the same process).
+type MemoryPersister struct {
+	lock     sync.Mutex
+	snapshot Snapshot
+	has      bool
+}
+
+func NewMemoryPersister() *MemoryPersister {
+	return &MemoryPersister{}
+}
+
+func (p *MemoryPersister) Save(snapshot Snapshot) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.snapshot = snapshot
+	p.has = true
+
+	return nil
+}
+
+func (p *MemoryPersister) Load() (Snapshot, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.has {
+		return Snapshot{}, ErrNoSnapshot
+	}
+
+	return p.snapshot, nil
+}
+
+// FilePersister is a Persister that stores a single Snapshot as JSON at
+// path, writing to a temporary file first so a Save interrupted mid-write
+// can't corrupt the last good snapshot.
+type FilePersister struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewFilePersister(path string) *FilePersister {
+	return &FilePersister{path: path}
+}
+
+func (p *FilePersister) Save(snapshot Snapshot) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := p.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, p.path)
+}
+
+func (p *FilePersister) Load() (Snapshot, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	data, err := os.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return Snapshot{}, ErrNoSnapshot
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return Snapshot{}, err
+	}
+
+	return snapshot, nil
+}
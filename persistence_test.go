@@ -0,0 +1,96 @@
+package statemachine
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitForSnapshot(t *testing.T, p Persister, stateID string) Snapshot {
+	t.Helper()
+
+	// Snapshots are saved asynchronously, so an earlier transition's
+	// snapshot may be loadable before the one for stateID arrives.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		snapshot, err := p.Load()
+		if err == nil && snapshot.StateID == stateID {
+			return snapshot
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatal("persister never received a snapshot for state", stateID)
+	return Snapshot{}
+}
+
+func TestStateMachineResumeFromMemoryPersister(t *testing.T) {
+	persister := NewMemoryPersister()
+
+	sm := NewStateMachine()
+	sm.WithPersister(persister)
+	sm.SetSnapshotData("payload")
+
+	sm.AddState(&State{
+		ID: "01",
+		Selector: LegacySelector(func(state *State) string {
+			return "02"
+		}),
+	})
+	sm.AddState(&State{ID: "02"})
+
+	sm.Start("01", true)
+	sm.Advance()
+
+	snapshot := waitForSnapshot(t, persister, "02")
+	if snapshot.StateID != "02" {
+		t.Fatal("expected snapshot to record state 02, got", snapshot.StateID)
+	}
+
+	resumed := NewStateMachine()
+	resumed.WithPersister(persister)
+	resumed.AddState(&State{ID: "01"})
+	resumed.AddState(&State{ID: "02"})
+
+	if err := resumed.Resume(); err != nil {
+		t.Fatal("unexpected error resuming:", err)
+	}
+	if resumed.CurrentState().ID != "02" {
+		t.Fatal("expected resumed machine to be in state 02, got", resumed.CurrentState().ID)
+	}
+	if resumed.Clock("02") != 1 {
+		t.Fatal("expected resumed clock for 02 to carry over, got", resumed.Clock("02"))
+	}
+	if data, _ := resumed.snapshotData.(string); data != "payload" {
+		t.Fatal("expected resumed snapshot data to carry over, got", resumed.snapshotData)
+	}
+}
+
+func TestStateMachineResumeFromFilePersister(t *testing.T) {
+	persister := NewFilePersister(filepath.Join(t.TempDir(), "snapshot.json"))
+
+	sm := NewStateMachine()
+	sm.WithPersister(persister)
+	sm.AddState(&State{ID: "01"})
+
+	sm.Start("01", true)
+	waitForSnapshot(t, persister, "01")
+
+	resumed := NewStateMachine()
+	resumed.WithPersister(persister)
+	resumed.AddState(&State{ID: "01"})
+
+	if err := resumed.Resume(); err != nil {
+		t.Fatal("unexpected error resuming:", err)
+	}
+	if resumed.CurrentState().ID != "01" {
+		t.Fatal("expected resumed machine to be in state 01, got", resumed.CurrentState().ID)
+	}
+}
+
+func TestStateMachineResumeWithoutPersister(t *testing.T) {
+	sm := NewStateMachine()
+	if err := sm.Resume(); err != ErrNoPersister {
+		t.Fatal("expected ErrNoPersister, got", err)
+	}
+}
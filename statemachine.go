@@ -1,19 +1,45 @@
 package statemachine
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 )
 
 const NoState = ""
 
-type StateEvent func(sm *StateMachine)
-type TimeoutEvent func(sm *StateMachine, eventType EventType)
-type StateSelector func(state *State) string
+type StateEvent func(ctx context.Context, sm *StateMachine, args ...interface{})
+type TimeoutEvent func(ctx context.Context, sm *StateMachine, eventType EventType)
+type StateSelector func(ctx context.Context, state *State, args ...interface{}) string
 type ErrorHandler func(err interface{}, eventType EventType)
 
+// LegacyStateEvent adapts a pre-context handler (func(sm *StateMachine)) to
+// the current context-aware StateEvent signature, for callers migrating
+// existing handlers without rewriting them.
+func LegacyStateEvent(fn func(sm *StateMachine)) StateEvent {
+	return func(ctx context.Context, sm *StateMachine, args ...interface{}) {
+		fn(sm)
+	}
+}
+
+// LegacyTimeoutEvent adapts a pre-context handler to the current
+// context-aware TimeoutEvent signature.
+func LegacyTimeoutEvent(fn func(sm *StateMachine, eventType EventType)) TimeoutEvent {
+	return func(ctx context.Context, sm *StateMachine, eventType EventType) {
+		fn(sm, eventType)
+	}
+}
+
+// LegacySelector adapts a pre-context handler to the current context-aware
+// StateSelector signature.
+func LegacySelector(fn func(state *State) string) StateSelector {
+	return func(ctx context.Context, state *State, args ...interface{}) string {
+		return fn(state)
+	}
+}
+
 type EventType int
 
 const (
@@ -22,35 +48,201 @@ const (
 	EventState
 )
 
+// String renders eventType the way ErrTimeout's message does.
+func (eventType EventType) String() string {
+	switch eventType {
+	case EventEnter:
+		return "enter"
+	case EventLeave:
+		return "leave"
+	case EventState:
+		return "state"
+	default:
+		return "unknown"
+	}
+}
+
+// TransitionCause records what triggered a Transition.
+type TransitionCause int
+
+const (
+	CauseNormal TransitionCause = iota
+	CauseEmergency
+	CauseAuto
+	CauseTimeout
+)
+
+// Transition is a record of one completed (or failed) switch between
+// states, kept in the StateMachine's bounded History and broadcast to any
+// Subscribe channels.
+type Transition struct {
+	From      string
+	To        string
+	Timestamp time.Time
+	Tick      uint64
+	Cause     TransitionCause
+	Err       error
+}
+
+// historyCapacity bounds the in-memory Transition ring buffer.
+const historyCapacity = 256
+
+// ErrNoSuchState is returned when a switch names a state that was never
+// registered with AddState or AddSubstate.
+type ErrNoSuchState struct {
+	StateID string
+}
+
+func (e ErrNoSuchState) Error() string {
+	return fmt.Sprintf("statemachine: no such state %q", e.StateID)
+}
+
+// ErrTimeout is returned when a handler run during a switch missed its own
+// OnEnterTimeout or OnLeaveTimeout deadline. The switch itself still
+// completes; EventType names which phase timed out.
+type ErrTimeout struct {
+	EventType EventType
+}
+
+func (e ErrTimeout) Error() string {
+	return fmt.Sprintf("statemachine: handler timed out during %s", e.EventType)
+}
+
+// ErrHandlerPanic is returned when an OnEnter or OnLeave handler panicked.
+// Recovered holds whatever value was passed to panic.
+type ErrHandlerPanic struct {
+	Recovered interface{}
+}
+
+func (e ErrHandlerPanic) Error() string {
+	return fmt.Sprintf("statemachine: handler panicked: %v", e.Recovered)
+}
+
+// Result reports the outcome of a switch requested via Start, Advance or
+// EmergencySwitch (and their Context variants). Err is non-nil for an
+// ErrNoSuchState, ErrHandlerPanic, or a soft ErrTimeout that still let the
+// switch complete (Transitioned is true in that last case).
+type Result struct {
+	Transitioned bool
+	Err          error
+}
+
 type State struct {
 	ID             string
+	Parent         string
 	OnEnter        StateEvent
+	OnEnterFrom    map[string]StateEvent
 	OnEnterTimeout time.Duration
 	OnLeave        StateEvent
 	OnLeaveTimeout time.Duration
 	Selector       StateSelector
 	StateTimeout   time.Duration
+
+	// PossibleNextStates documents the state IDs this state's Selector
+	// may return. Selector itself is an arbitrary func and can't be
+	// introspected, so ExportDOT and ExportMermaid rely on this field to
+	// draw the corresponding edges.
+	PossibleNextStates []string
+}
+
+// stateBox wraps *State so it can be stored in an atomic.Value, which
+// panics on a Store of a nil interface value; storing stateBox{} is how
+// current is reset to hold no state.
+type stateBox struct {
+	state *State
+}
+
+// switchRequest is a mutation enqueued on a StateMachine's requests channel.
+// It is picked up and applied by the single dispatcher goroutine started in
+// NewStateMachine, so current, clock and history are only ever mutated from
+// that one goroutine. clock and history still keep locks of their own
+// because Clock, Clocks and History read them from other goroutines.
+type switchRequest struct {
+	ctx           context.Context
+	toState       string
+	useSelector   bool
+	trigger       bool
+	cause         TransitionCause
+	args          []interface{}
+	resume        *Snapshot
+	snapshotData  *interface{}
+	cancelTimeout bool
+	reply         chan Result
 }
 
 type StateMachine struct {
-	current              unsafe.Pointer
-	states               map[string]*State
-	advanceLock          sync.Mutex
-	onTimeout            TimeoutEvent
-	onError              ErrorHandler
-	timeoutTracker       chan struct{}
-	timeoutTrackerActive bool
-	timeoutLock          sync.Mutex
-	eventLock            sync.Mutex
+	current   atomic.Value
+	states    map[string]*State
+	requests  chan switchRequest
+	onTimeout TimeoutEvent
+	onError   ErrorHandler
+
+	activeTimeoutCancel context.CancelFunc
+
+	persister       Persister
+	persistRequests chan Snapshot
+	snapshotData    interface{}
+
+	clock     map[string]uint64
+	clockLock sync.Mutex
+
+	history     []Transition
+	historyLock sync.Mutex
+
+	subscribers []chan Transition
+	subLock     sync.Mutex
+
+	stopOnce sync.Once
 }
 
 func NewStateMachine() *StateMachine {
-	return &StateMachine{
-		states:         make(map[string]*State),
-		timeoutTracker: make(chan struct{}, 1),
+	sm := &StateMachine{
+		states:          make(map[string]*State),
+		requests:        make(chan switchRequest),
+		persistRequests: make(chan Snapshot, 1),
+		clock:           make(map[string]uint64),
+		history:         make([]Transition, 0, historyCapacity),
+	}
+
+	go sm.run()
+	go sm.runPersistWriter()
+
+	return sm
+}
+
+// run is the single dispatcher goroutine that applies every switchRequest
+// serially, so current, clock, history and the active StateTimeout
+// watchdog are only ever changed from this one goroutine. clock and
+// history are still locked for readers on other goroutines.
+func (sm *StateMachine) run() {
+	for req := range sm.requests {
+		req.reply <- sm.process(req)
 	}
 }
 
+// dispatch enqueues req and blocks for the dispatcher's reply.
+func (sm *StateMachine) dispatch(req switchRequest) Result {
+	req.reply = make(chan Result, 1)
+	sm.requests <- req
+
+	return <-req.reply
+}
+
+// Stop cancels any armed StateTimeout watchdog and terminates the
+// dispatcher goroutine and the persist writer goroutine, both started by
+// NewStateMachine whether or not a Persister is configured, so sm can be
+// garbage collected. Safe to call more than once; any switchRequest
+// already in flight when Stop is called still completes. Start, Advance,
+// EmergencySwitch and Resume must not be called after Stop — like
+// sending on any closed channel, doing so panics.
+func (sm *StateMachine) Stop() {
+	sm.stopOnce.Do(func() {
+		sm.dispatch(switchRequest{cancelTimeout: true})
+		close(sm.requests)
+		close(sm.persistRequests)
+	})
+}
+
 func (sm *StateMachine) WithTimeoutHandler(th TimeoutEvent) {
 	sm.onTimeout = th
 }
@@ -63,188 +255,551 @@ func (sm *StateMachine) AddState(state *State) {
 	sm.states[state.ID] = state
 }
 
-func (sm *StateMachine) Start(initialState string, triggerEvents ...bool) (bool, interface{}) {
+// AddSubstate registers parent (if not already known) and child, linking
+// child to parent so that entering child also enters parent (and further
+// ancestors) and leaving child towards a non-descendant leaves it too.
+func (sm *StateMachine) AddSubstate(parent, child *State) {
+	if _, exists := sm.states[parent.ID]; !exists {
+		sm.AddState(parent)
+	}
+	child.Parent = parent.ID
+	sm.AddState(child)
+}
+
+// Start switches the machine into initialState using context.Background().
+// See StartContext to supply a caller context.
+func (sm *StateMachine) Start(initialState string, triggerEvents ...bool) Result {
+	return sm.StartContext(context.Background(), initialState, triggerEvents...)
+}
+
+// StartContext switches the machine into initialState, passing ctx through
+// to any OnEnter handler that runs.
+func (sm *StateMachine) StartContext(ctx context.Context, initialState string, triggerEvents ...bool) Result {
 	doTrigger := false
 	if len(triggerEvents) > 0 {
 		doTrigger = triggerEvents[0]
 	}
 
-	return sm.internalSwitch(initialState, doTrigger)
+	return sm.dispatch(switchRequest{ctx: ctx, toState: initialState, trigger: doTrigger, cause: CauseNormal})
 }
 
-func (sm *StateMachine) runStateEvent(event StateEvent, timeout time.Duration, eventType EventType) interface{} {
-	if event == nil {
+// ancestorChain returns state and its ancestors, innermost first.
+func (sm *StateMachine) ancestorChain(state *State) []*State {
+	chain := []*State{}
+	for state != nil {
+		chain = append(chain, state)
+		if state.Parent == NoState {
+			break
+		}
+		state = sm.states[state.Parent]
+	}
+
+	return chain
+}
+
+// leaveChain returns the states that must be left when switching from
+// "from" to "to", innermost first, stopping at (and excluding) their
+// lowest common ancestor.
+func (sm *StateMachine) leaveChain(from, to *State) []*State {
+	if from == nil {
 		return nil
 	}
-	var errPtr unsafe.Pointer
 
-	errHandler := func() {
-		errLocal := recover()
-		if errLocal != nil && sm.onError != nil {
-			atomic.StorePointer(&errPtr, unsafe.Pointer(&errLocal))
-			sm.onError(errLocal, eventType)
+	keep := map[string]bool{}
+	for _, s := range sm.ancestorChain(to) {
+		keep[s.ID] = true
+	}
+
+	leave := []*State{}
+	for _, s := range sm.ancestorChain(from) {
+		if keep[s.ID] {
+			break
 		}
+		leave = append(leave, s)
 	}
 
-	if timeout.Nanoseconds() == 0 {
-		func() {
-			defer errHandler()
-			event(sm)
-		}()
-	} else {
-		ch := make(chan struct{}, 1)
-		go func() {
-			defer errHandler()
-			event(sm)
-
-			_, ok := <-ch
-			if ok {
-				ch <- struct{}{}
-			}
-		}()
+	return leave
+}
 
-		select {
-		case <-ch:
-			close(ch)
-		case <-time.After(timeout):
-			close(ch)
-			if sm.onTimeout != nil {
-				sm.onTimeout(sm, eventType)
-			}
+// enterChain returns the states that must be entered when switching from
+// "from" to "to", outermost first, skipping ancestors already active.
+func (sm *StateMachine) enterChain(from, to *State) []*State {
+	if to == nil {
+		return nil
+	}
+
+	active := map[string]bool{}
+	for _, s := range sm.ancestorChain(from) {
+		active[s.ID] = true
+	}
+
+	enter := []*State{}
+	for _, s := range sm.ancestorChain(to) {
+		if active[s.ID] {
+			break
 		}
+		enter = append(enter, s)
 	}
 
-	err := (*interface{})(atomic.LoadPointer(&errPtr))
+	for i, j := 0, len(enter)-1; i < j; i, j = i+1, j-1 {
+		enter[i], enter[j] = enter[j], enter[i]
+	}
 
-	if err == nil {
-		return nil
+	return enter
+}
+
+// runStateEvent runs event in its own goroutine so that a cancellation or
+// deadline on ctx (whether inherited from the caller or imposed by timeout)
+// can be observed while the handler is still running, and reports it via
+// onTimeout when the cause was a deadline. The handler itself remains
+// responsible for returning promptly once it observes ctx.Done(). The
+// returned interface{} is the raw value recovered from a panic, if any.
+func (sm *StateMachine) runStateEvent(ctx context.Context, event StateEvent, timeout time.Duration, eventType EventType, args ...interface{}) (interface{}, bool) {
+	if event == nil {
+		return nil, false
 	}
 
-	return *err
+	evCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		evCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type outcome struct {
+		recovered interface{}
+	}
+
+	done := make(chan outcome, 1)
+
+	go func() {
+		var recovered interface{}
+		defer func() {
+			recovered = recover()
+			if recovered != nil && sm.onError != nil {
+				sm.onError(recovered, eventType)
+			}
+			done <- outcome{recovered: recovered}
+		}()
+		event(evCtx, sm, args...)
+	}()
+
+	timedOut := false
+
+	select {
+	case o := <-done:
+		return o.recovered, false
+	case <-evCtx.Done():
+		timedOut = evCtx.Err() == context.DeadlineExceeded
+		if timedOut && sm.onTimeout != nil {
+			sm.onTimeout(evCtx, sm, eventType)
+		}
+	}
+
+	return nil, timedOut
 }
 
-func (sm *StateMachine) leaveState(state *State, triggerEvents bool) interface{} {
-	if state != nil && triggerEvents && state.OnLeave != nil {
-		return sm.runStateEvent(state.OnLeave, state.OnLeaveTimeout, EventLeave)
+// leaveState runs OnLeave for the chain of states being exited while
+// switching from "from" towards "to", from the innermost state up to
+// (but excluding) their lowest common ancestor. It stops early if ctx is
+// canceled between handlers. The returned bool reports whether any
+// handler in the chain hit its own timeout.
+func (sm *StateMachine) leaveState(ctx context.Context, from, to *State, triggerEvents bool, args ...interface{}) (interface{}, bool) {
+	timedOut := false
+
+	for _, s := range sm.leaveChain(from, to) {
+		sm.current.Store(stateBox{state: s})
+		if triggerEvents && s.OnLeave != nil {
+			err, handlerTimedOut := sm.runStateEvent(ctx, s.OnLeave, s.OnLeaveTimeout, EventLeave, args...)
+			timedOut = timedOut || handlerTimedOut
+			if err != nil {
+				return err, timedOut
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
 	}
 
-	return nil
+	return nil, timedOut
 }
 
-func (sm *StateMachine) enterState(state *State, triggerEvents bool) (bool, interface{}) {
-	var err interface{}
-	atomic.StorePointer(&sm.current, unsafe.Pointer(state))
-	if state != nil {
-		if state.OnEnter != nil && triggerEvents {
-			err = sm.runStateEvent(state.OnEnter, state.OnEnterTimeout, EventEnter)
+// enterState runs OnEnter (and, for the target state, any OnEnterFrom
+// handler registered for "from") for the chain of states being entered
+// while switching from "from" towards "to", outermost ancestor first. It
+// stops early if ctx is canceled between handlers. The final bool reports
+// whether any handler in the chain hit its own timeout.
+func (sm *StateMachine) enterState(ctx context.Context, from, to *State, triggerEvents bool, args ...interface{}) (bool, interface{}, bool) {
+	if to == nil {
+		sm.current.Store(stateBox{})
+		return false, nil, false
+	}
+
+	fromId := NoState
+	if from != nil {
+		fromId = from.ID
+	}
+
+	timedOut := false
+
+	for _, s := range sm.enterChain(from, to) {
+		sm.current.Store(stateBox{state: s})
+		sm.tick(s.ID)
+
+		if !triggerEvents {
+			continue
 		}
-		if state.StateTimeout.Nanoseconds() > 0 {
-			sm.timeoutLock.Lock()
-			sm.timeoutTrackerActive = true
-			sm.timeoutLock.Unlock()
-			go func() {
-				defer func() {
-					sm.timeoutLock.Lock()
-					if sm.timeoutTrackerActive {
-						sm.timeoutTracker <- struct{}{}
-						sm.timeoutTrackerActive = false
-					}
-					sm.timeoutLock.Unlock()
-				}()
 
-				select {
-				case <-sm.timeoutTracker:
-				case <-time.After(state.StateTimeout):
-					if sm.onTimeout != nil {
-						sm.onTimeout(sm, EventState)
-					}
+		if s.OnEnter != nil {
+			err, handlerTimedOut := sm.runStateEvent(ctx, s.OnEnter, s.OnEnterTimeout, EventEnter, args...)
+			timedOut = timedOut || handlerTimedOut
+			if err != nil {
+				return true, err, timedOut
+			}
+		}
+
+		if s == to && s.OnEnterFrom != nil {
+			if handler := s.OnEnterFrom[fromId]; handler != nil {
+				err, handlerTimedOut := sm.runStateEvent(ctx, handler, s.OnEnterTimeout, EventEnter, args...)
+				timedOut = timedOut || handlerTimedOut
+				if err != nil {
+					return true, err, timedOut
 				}
-			}()
+			}
 		}
 
-		return true, err
+		if ctx.Err() != nil {
+			break
+		}
 	}
 
-	return false, err
+	sm.installStateTimeout(ctx, to, to.StateTimeout)
+
+	return true, nil, timedOut
+}
+
+// cancelStateTimeout cancels whatever StateTimeout watchdog is currently
+// armed, if any. It is only ever called from the dispatcher goroutine, so
+// it needs no lock of its own.
+func (sm *StateMachine) cancelStateTimeout() {
+	if sm.activeTimeoutCancel != nil {
+		sm.activeTimeoutCancel()
+		sm.activeTimeoutCancel = nil
+	}
 }
 
-func (sm *StateMachine) internalSwitch(toState string, triggerEvents bool) (bool, interface{}) {
+// installStateTimeout arms the StateTimeout watchdog for state, firing
+// onTimeout after duration unless canceled first by the next switch or by
+// ctx. duration is normally state.StateTimeout, but Resume passes the
+// remaining duration of a timeout that was already partway elapsed when
+// the snapshot was taken. Only ever called from the dispatcher goroutine.
+func (sm *StateMachine) installStateTimeout(ctx context.Context, state *State, duration time.Duration) {
+	if duration.Nanoseconds() <= 0 {
+		return
+	}
+
+	timeoutCtx, cancel := context.WithCancel(ctx)
+	sm.activeTimeoutCancel = cancel
+
+	go func() {
+		select {
+		case <-timeoutCtx.Done():
+		case <-time.After(duration):
+			cancel()
+			if sm.onTimeout != nil {
+				sm.onTimeout(ctx, sm, EventState)
+			}
+		}
+	}()
+}
+
+// process applies req on the dispatcher goroutine: it is the only place
+// that mutates current, clock, history and snapshotData. current and
+// snapshotData need no lock of their own for that; clock and history are
+// still locked because other goroutines read them.
+func (sm *StateMachine) process(req switchRequest) Result {
+	if req.resume != nil {
+		return sm.resumeFrom(*req.resume)
+	}
+
+	if req.snapshotData != nil {
+		sm.snapshotData = *req.snapshotData
+		return Result{}
+	}
+
+	if req.cancelTimeout {
+		sm.cancelStateTimeout()
+		return Result{}
+	}
+
+	ctx := req.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	toState := req.toState
+	if req.useSelector {
+		toState = sm.getNextState(ctx, req.args...)
+	}
+
 	if toState == NoState {
-		return false, nil
+		return Result{}
+	}
+
+	// nState is looked up but not validated yet: leaveState below must still
+	// run against whatever is current, exactly as it would for a known
+	// target, before an unknown toState turns into ErrNoSuchState. Checking
+	// first and returning early would skip the current state's OnLeave.
+	nState, ok := sm.states[toState]
+
+	sm.cancelStateTimeout()
+
+	fromState := sm.CurrentState()
+	fromId := NoState
+	if fromState != nil {
+		fromId = fromState.ID
+	}
+
+	rawErr, leaveTimedOut := sm.leaveState(ctx, fromState, nState, req.trigger, req.args...)
+	if rawErr != nil {
+		err := ErrHandlerPanic{Recovered: rawErr}
+		sm.recordTransition(fromId, toState, sm.transitionCause(req.cause, leaveTimedOut), err)
+
+		return Result{Err: err}
 	}
 
-	sm.timeoutLock.Lock()
-	if sm.timeoutTrackerActive {
-		sm.timeoutTracker <- struct{}{}
-		sm.timeoutTrackerActive = false
+	if !ok {
+		// leaveState just walked (and stored as current) from's entire
+		// ancestor chain, since leaveChain treats an unknown target as
+		// sharing no common ancestor with "from". The switch never
+		// happened, so current must land back on fromState, not wherever
+		// that walk left it nor the nil enterState would store for a
+		// genuinely empty target.
+		sm.current.Store(stateBox{state: fromState})
+
+		err := ErrNoSuchState{StateID: toState}
+		sm.recordTransition(fromId, toState, sm.transitionCause(req.cause, leaveTimedOut), err)
+
+		return Result{Err: err}
 	}
-	sm.timeoutLock.Unlock()
 
-	sm.eventLock.Lock()
-	err := sm.leaveState(sm.CurrentState(), triggerEvents)
-	sm.eventLock.Unlock()
+	transitioned, rawErr, enterTimedOut := sm.enterState(ctx, fromState, nState, req.trigger, req.args...)
 
-	if err != nil {
-		return false, err
+	var err error
+	switch {
+	case rawErr != nil:
+		err = ErrHandlerPanic{Recovered: rawErr}
+	case leaveTimedOut:
+		err = ErrTimeout{EventType: EventLeave}
+	case enterTimedOut:
+		err = ErrTimeout{EventType: EventEnter}
 	}
 
-	nState, _ := sm.states[toState]
+	sm.recordTransition(fromId, toState, sm.transitionCause(req.cause, leaveTimedOut || enterTimedOut), err)
 
-	result := false
-	sm.eventLock.Lock()
-	result, err = sm.enterState(nState, triggerEvents)
-	sm.eventLock.Unlock()
+	if transitioned && rawErr == nil {
+		sm.persistAsync()
+	}
 
-	return result, err
+	return Result{Transitioned: transitioned, Err: err}
 }
 
-func (sm *StateMachine) getNextState() string {
-	advanceId := NoState
+// transitionCause reports CauseTimeout whenever a handler along the
+// transition missed its own deadline, regardless of what triggered the
+// transition in the first place; otherwise it reports the given cause.
+func (sm *StateMachine) transitionCause(cause TransitionCause, timedOut bool) TransitionCause {
+	if timedOut {
+		return CauseTimeout
+	}
+
+	return cause
+}
+
+// getNextState asks the current state's Selector for the next state ID,
+// passing through the args given to Advance/AdvanceContext, and bubbling
+// up to ancestor selectors when a state has no selector of its own or its
+// selector finds no matching transition.
+func (sm *StateMachine) getNextState(ctx context.Context, args ...interface{}) string {
 	current := sm.CurrentState()
 
-	if current != nil && current.Selector != nil {
-		advanceId = current.Selector(current)
+	for current != nil {
+		if current.Selector != nil {
+			if next := current.Selector(ctx, current, args...); next != NoState {
+				return next
+			}
+		}
+
+		if current.Parent == NoState {
+			break
+		}
+		current = sm.states[current.Parent]
 	}
 
-	return advanceId
+	return NoState
 }
 
-func (sm *StateMachine) Advance() (bool, interface{}) {
-	sm.advanceLock.Lock()
-	defer sm.advanceLock.Unlock()
+// Advance switches to the next state using context.Background(). See
+// AdvanceContext to supply a caller context and payload args.
+func (sm *StateMachine) Advance(args ...interface{}) Result {
+	return sm.AdvanceContext(context.Background(), args...)
+}
 
-	if sm.current == nil {
-		return false, nil
-	}
+// AdvanceContext switches to the next state as chosen by the current
+// state's Selector, passing ctx and args through to the selector and to
+// any OnEnter/OnLeave handlers that run.
+func (sm *StateMachine) AdvanceContext(ctx context.Context, args ...interface{}) Result {
+	return sm.advance(ctx, CauseNormal, args...)
+}
 
-	return sm.internalSwitch(sm.getNextState(), true)
+// advance is the shared implementation behind AdvanceContext and the
+// auto-advance loop, which tags the resulting Transition with its own
+// cause instead of CauseNormal. The Selector is resolved on the dispatcher
+// goroutine itself, against whatever state is current at the time the
+// request is actually processed, so concurrent callers can't race each
+// other into resolving the same stale current state.
+func (sm *StateMachine) advance(ctx context.Context, cause TransitionCause, args ...interface{}) Result {
+	return sm.dispatch(switchRequest{ctx: ctx, useSelector: true, trigger: true, cause: cause, args: args})
 }
 
 func (sm *StateMachine) CurrentState() *State {
-	ptr := atomic.LoadPointer(&sm.current)
-	if ptr == nil {
-		return nil
+	box, _ := sm.current.Load().(stateBox)
+
+	return box.state
+}
+
+// tick bumps stateID's entry counter and returns its new value.
+func (sm *StateMachine) tick(stateID string) uint64 {
+	sm.clockLock.Lock()
+	defer sm.clockLock.Unlock()
+
+	sm.clock[stateID]++
+
+	return sm.clock[stateID]
+}
+
+// Clock returns how many times stateID has been entered so far.
+func (sm *StateMachine) Clock(stateID string) uint64 {
+	sm.clockLock.Lock()
+	defer sm.clockLock.Unlock()
+
+	return sm.clock[stateID]
+}
+
+// Clocks returns a snapshot of the entry counters for every state that has
+// been entered at least once.
+func (sm *StateMachine) Clocks() map[string]uint64 {
+	sm.clockLock.Lock()
+	defer sm.clockLock.Unlock()
+
+	clocks := make(map[string]uint64, len(sm.clock))
+	for id, tick := range sm.clock {
+		clocks[id] = tick
+	}
+
+	return clocks
+}
+
+// recordTransition appends t to the bounded history ring buffer and
+// broadcasts it to any live Subscribe channels, dropping it for a
+// subscriber whose channel is full rather than blocking the transition.
+func (sm *StateMachine) recordTransition(from, to string, cause TransitionCause, err error) {
+	t := Transition{
+		From:      from,
+		To:        to,
+		Timestamp: time.Now(),
+		Tick:      sm.Clock(to),
+		Cause:     cause,
+		Err:       err,
 	}
 
-	return (*State)(ptr)
+	sm.historyLock.Lock()
+	if len(sm.history) == historyCapacity {
+		sm.history = append(sm.history[1:], t)
+	} else {
+		sm.history = append(sm.history, t)
+	}
+	sm.historyLock.Unlock()
+
+	sm.subLock.Lock()
+	for _, ch := range sm.subscribers {
+		select {
+		case ch <- t:
+		default:
+		}
+	}
+	sm.subLock.Unlock()
+}
+
+// History returns the n most recent transitions, oldest first. n <= 0 or
+// n larger than the available history returns everything recorded.
+func (sm *StateMachine) History(n int) []Transition {
+	sm.historyLock.Lock()
+	defer sm.historyLock.Unlock()
+
+	if n <= 0 || n > len(sm.history) {
+		n = len(sm.history)
+	}
+
+	out := make([]Transition, n)
+	copy(out, sm.history[len(sm.history)-n:])
+
+	return out
 }
 
-func (sm *StateMachine) EmergencySwitch(stateId string, triggerEvents ...bool) (bool, interface{}) {
-	sm.advanceLock.Lock()
-	defer sm.advanceLock.Unlock()
+// Subscribe returns a channel that receives every future Transition. The
+// channel is buffered; a slow subscriber misses transitions rather than
+// stalling the state machine.
+func (sm *StateMachine) Subscribe() <-chan Transition {
+	ch := make(chan Transition, 16)
 
-	return sm.internalSwitch(stateId, len(triggerEvents) > 0 && triggerEvents[0])
+	sm.subLock.Lock()
+	sm.subscribers = append(sm.subscribers, ch)
+	sm.subLock.Unlock()
+
+	return ch
+}
+
+// EmergencySwitch forces an immediate transition using context.Background().
+// See EmergencySwitchContext to supply a caller context.
+func (sm *StateMachine) EmergencySwitch(stateId string, triggerEvents ...bool) Result {
+	return sm.EmergencySwitchContext(context.Background(), stateId, triggerEvents...)
+}
+
+// EmergencySwitchContext forces an immediate transition to stateId,
+// bypassing Selector resolution, passing ctx through to any handler.
+func (sm *StateMachine) EmergencySwitchContext(ctx context.Context, stateId string, triggerEvents ...bool) Result {
+	return sm.dispatch(switchRequest{
+		ctx:     ctx,
+		toState: stateId,
+		trigger: len(triggerEvents) > 0 && triggerEvents[0],
+		cause:   CauseEmergency,
+	})
+}
+
+// AutoAdvance repeatedly advances using context.Background(). See
+// AutoAdvanceContext to supply a caller context that can stop the loop.
+func (sm *StateMachine) AutoAdvance(tryPeriod time.Duration, terminalStates []string) error {
+	return sm.AutoAdvanceContext(context.Background(), tryPeriod, terminalStates)
 }
 
-func (sm *StateMachine) AutoAdvance(tryPeriod time.Duration, terminalStates []string) interface{} {
+// AutoAdvanceContext repeatedly advances until a terminal state is
+// reached, a handler errors, or ctx is canceled, in which case ctx.Err()
+// is returned.
+func (sm *StateMachine) AutoAdvanceContext(ctx context.Context, tryPeriod time.Duration, terminalStates []string) error {
 	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
 		ct := time.Now()
-		result, err := sm.Advance()
-		if err != nil {
+		result := sm.advance(ctx, CauseAuto)
+		if result.Err != nil {
 			// stop state machine
-			return err
+			return result.Err
 		}
-		if result {
+		if result.Transitioned {
 			cs := sm.CurrentState().ID
 			for _, ts := range terminalStates {
 				if cs == ts {
@@ -256,7 +811,11 @@ func (sm *StateMachine) AutoAdvance(tryPeriod time.Duration, terminalStates []st
 			// cannot advance yet, wait
 			passed := time.Now().Sub(ct)
 			if passed.Nanoseconds() < tryPeriod.Nanoseconds() {
-				time.Sleep(time.Duration(tryPeriod.Nanoseconds() - passed.Nanoseconds()))
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(time.Duration(tryPeriod.Nanoseconds() - passed.Nanoseconds())):
+				}
 			}
 		}
 	}
@@ -1,6 +1,8 @@
 package statemachine
 
 import (
+	"context"
+	"runtime"
 	"strconv"
 	"sync"
 	"testing"
@@ -42,15 +44,15 @@ func TestStateMachine(t *testing.T) {
 
 	actions := []string{}
 
-	onEnter := func(sm *StateMachine) {
+	onEnter := LegacyStateEvent(func(sm *StateMachine) {
 		action := "enter " + sm.CurrentState().ID
 		actions = append(actions, action)
-	}
+	})
 
-	onLeave := func(sm *StateMachine) {
+	onLeave := LegacyStateEvent(func(sm *StateMachine) {
 		action := "leave " + sm.CurrentState().ID
 		actions = append(actions, action)
-	}
+	})
 
 	for i := 1; i <= 10; i++ {
 		stateId := strconv.Itoa(i)
@@ -61,18 +63,18 @@ func TestStateMachine(t *testing.T) {
 			ID:       stateId,
 			OnEnter:  onEnter,
 			OnLeave:  onLeave,
-			Selector: app.SelectNextState,
+			Selector: LegacySelector(app.SelectNextState),
 		})
 	}
 
-	if res, _ := sm.Start("01", true); res {
+	if result := sm.Start("01", true); result.Transitioned {
 		action := "process current state: " + sm.CurrentState().ID
 		actions = append(actions, action)
 	}
 
 	for {
-		res, _ := sm.Advance()
-		if !res {
+		result := sm.Advance()
+		if !result.Transitioned {
 			break
 		}
 		action := "process current state: " + sm.CurrentState().ID
@@ -126,13 +128,13 @@ func TestStateMachineTimeouts(t *testing.T) {
 	}
 
 	sm := NewStateMachine()
-	sm.WithTimeoutHandler(func(sm *StateMachine, timeoutType EventType) {
+	sm.WithTimeoutHandler(LegacyTimeoutEvent(func(sm *StateMachine, timeoutType EventType) {
 		aLock.Lock()
 		actions = append(actions, "timeout for "+sm.CurrentState().ID+" on type "+timeoutTypeStr(timeoutType))
 		aLock.Unlock()
-	})
+	}))
 
-	onEnter := func(sm *StateMachine) {
+	onEnter := LegacyStateEvent(func(sm *StateMachine) {
 		action := "enter " + sm.CurrentState().ID
 		aLock.Lock()
 		actions = append(actions, action)
@@ -140,9 +142,9 @@ func TestStateMachineTimeouts(t *testing.T) {
 		if sm.CurrentState().ID == "01" {
 			time.Sleep(time.Second * 2)
 		}
-	}
+	})
 
-	onLeave := func(sm *StateMachine) {
+	onLeave := LegacyStateEvent(func(sm *StateMachine) {
 		action := "leave " + sm.CurrentState().ID
 		aLock.Lock()
 		actions = append(actions, action)
@@ -150,7 +152,7 @@ func TestStateMachineTimeouts(t *testing.T) {
 		if sm.CurrentState().ID == "01" {
 			time.Sleep(time.Second * 2)
 		}
-	}
+	})
 
 	sm.AddState(&State{
 		ID:             "01",
@@ -159,18 +161,18 @@ func TestStateMachineTimeouts(t *testing.T) {
 		OnEnterTimeout: time.Second,
 		OnLeaveTimeout: time.Second,
 		StateTimeout:   time.Second,
-		Selector: func(state *State) string {
+		Selector: LegacySelector(func(state *State) string {
 			return "02"
-		},
+		}),
 	})
 	sm.AddState(&State{
 		ID:           "02",
 		OnEnter:      onEnter,
 		OnLeave:      onLeave,
 		StateTimeout: time.Second,
-		Selector: func(state *State) string {
+		Selector: LegacySelector(func(state *State) string {
 			return "03"
-		},
+		}),
 	})
 	sm.AddState(&State{
 		ID:      "03",
@@ -210,15 +212,15 @@ func TestStateMachineAutoAdvance(t *testing.T) {
 
 	actions := []string{}
 
-	onEnter := func(sm *StateMachine) {
+	onEnter := LegacyStateEvent(func(sm *StateMachine) {
 		action := "enter and process " + sm.CurrentState().ID
 		actions = append(actions, action)
-	}
+	})
 
-	onLeave := func(sm *StateMachine) {
+	onLeave := LegacyStateEvent(func(sm *StateMachine) {
 		action := "leave " + sm.CurrentState().ID
 		actions = append(actions, action)
-	}
+	})
 
 	for i := 1; i <= 10; i++ {
 		stateId := strconv.Itoa(i)
@@ -229,7 +231,7 @@ func TestStateMachineAutoAdvance(t *testing.T) {
 			ID:       stateId,
 			OnEnter:  onEnter,
 			OnLeave:  onLeave,
-			Selector: app.SelectNextState,
+			Selector: LegacySelector(app.SelectNextState),
 		})
 	}
 
@@ -258,35 +260,35 @@ func TestStateMachineErrorHandling(t *testing.T) {
 		actions = append(actions, errS)
 	})
 
-	onEnter := func(sm *StateMachine) {
+	onEnter := LegacyStateEvent(func(sm *StateMachine) {
 		if sm.CurrentState().ID == "02" {
 			panic("explicit panic")
 		}
 
 		action := "enter " + sm.CurrentState().ID
 		actions = append(actions, action)
-	}
+	})
 
-	onLeave := func(sm *StateMachine) {
+	onLeave := LegacyStateEvent(func(sm *StateMachine) {
 		action := "leave " + sm.CurrentState().ID
 		actions = append(actions, action)
-	}
+	})
 
 	sm.AddState(&State{
 		ID:      "01",
 		OnEnter: onEnter,
 		OnLeave: onLeave,
-		Selector: func(state *State) string {
+		Selector: LegacySelector(func(state *State) string {
 			return "02"
-		},
+		}),
 	})
 	sm.AddState(&State{
 		ID:      "02",
 		OnEnter: onEnter,
 		OnLeave: onLeave,
-		Selector: func(state *State) string {
+		Selector: LegacySelector(func(state *State) string {
 			return NoState
-		},
+		}),
 	})
 
 	sm.Start("01", true)
@@ -301,6 +303,72 @@ func TestStateMachineErrorHandling(t *testing.T) {
 	verifyActions(t, expected, actions)
 }
 
+func TestStateMachineSubstates(t *testing.T) {
+	sm := NewStateMachine()
+
+	actions := []string{}
+
+	onEnter := LegacyStateEvent(func(sm *StateMachine) {
+		actions = append(actions, "enter "+sm.CurrentState().ID)
+	})
+	onLeave := LegacyStateEvent(func(sm *StateMachine) {
+		actions = append(actions, "leave "+sm.CurrentState().ID)
+	})
+
+	parent := &State{
+		ID:      "parent",
+		OnEnter: onEnter,
+		OnLeave: onLeave,
+		Selector: LegacySelector(func(state *State) string {
+			return "sibling"
+		}),
+	}
+	child1 := &State{
+		ID:      "child1",
+		OnEnter: onEnter,
+		OnLeave: onLeave,
+		OnEnterFrom: map[string]StateEvent{
+			"child2": LegacyStateEvent(func(sm *StateMachine) {
+				actions = append(actions, "enter child1 from child2")
+			}),
+		},
+	}
+	child2 := &State{
+		ID:      "child2",
+		OnEnter: onEnter,
+		OnLeave: onLeave,
+		Selector: LegacySelector(func(state *State) string {
+			return "child1"
+		}),
+	}
+	sibling := &State{
+		ID:      "sibling",
+		OnEnter: onEnter,
+		OnLeave: onLeave,
+	}
+
+	sm.AddSubstate(parent, child1)
+	sm.AddSubstate(parent, child2)
+	sm.AddState(sibling)
+
+	sm.Start("child2", true)
+	sm.Advance() // child2 -> child1, parent stays entered
+	sm.EmergencySwitch("sibling", true)
+
+	expected := []string{
+		"enter parent",
+		"enter child2",
+		"leave child2",
+		"enter child1",
+		"enter child1 from child2",
+		"leave child1",
+		"leave parent",
+		"enter sibling",
+	}
+
+	verifyActions(t, expected, actions)
+}
+
 func TestStateMachineAutoAdvanceErrorHandling(t *testing.T) {
 	actions := []string{}
 	state2counter := 0
@@ -315,7 +383,7 @@ func TestStateMachineAutoAdvanceErrorHandling(t *testing.T) {
 		desiredSequence: []string{"01", "02", "03", "05", "08", "09", "11"},
 	}
 
-	onEnter := func(sm *StateMachine) {
+	onEnter := LegacyStateEvent(func(sm *StateMachine) {
 		st := sm.CurrentState().ID
 		if st == "03" {
 			panic("explicit panic at 03")
@@ -323,12 +391,12 @@ func TestStateMachineAutoAdvanceErrorHandling(t *testing.T) {
 
 		action := "enter and process " + sm.CurrentState().ID
 		actions = append(actions, action)
-	}
+	})
 
-	onLeave := func(sm *StateMachine) {
+	onLeave := LegacyStateEvent(func(sm *StateMachine) {
 		action := "leave " + sm.CurrentState().ID
 		actions = append(actions, action)
-	}
+	})
 
 	for i := 1; i <= 10; i++ {
 		stateId := strconv.Itoa(i)
@@ -339,7 +407,7 @@ func TestStateMachineAutoAdvanceErrorHandling(t *testing.T) {
 			ID:      stateId,
 			OnEnter: onEnter,
 			OnLeave: onLeave,
-			Selector: func(state *State) string {
+			Selector: LegacySelector(func(state *State) string {
 				ns := NoState
 				for i := 0; i < len(app.desiredSequence)-1; i++ {
 					if app.desiredSequence[i] == state.ID {
@@ -358,7 +426,7 @@ func TestStateMachineAutoAdvanceErrorHandling(t *testing.T) {
 				}
 
 				return ns
-			},
+			}),
 		})
 	}
 
@@ -377,3 +445,250 @@ func TestStateMachineAutoAdvanceErrorHandling(t *testing.T) {
 
 	verifyActions(t, expected, actions)
 }
+
+func TestStateMachineContextCancellation(t *testing.T) {
+	sm := NewStateMachine()
+
+	aLock := sync.Mutex{}
+	actions := []string{}
+	entered := make(chan struct{})
+	handlerDone := make(chan struct{})
+
+	sm.AddState(&State{
+		ID: "01",
+		OnEnter: func(ctx context.Context, sm *StateMachine, args ...interface{}) {
+			aLock.Lock()
+			actions = append(actions, "enter 01")
+			aLock.Unlock()
+			close(entered)
+			<-ctx.Done()
+			aLock.Lock()
+			actions = append(actions, "canceled 01")
+			aLock.Unlock()
+			close(handlerDone)
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go sm.StartContext(ctx, "01", true)
+
+	<-entered
+	cancel()
+	<-handlerDone
+
+	aLock.Lock()
+	expected := []string{"enter 01", "canceled 01"}
+	verifyActions(t, expected, actions)
+	aLock.Unlock()
+}
+
+func TestStateMachineArgsReachSelectorAndHandlers(t *testing.T) {
+	sm := NewStateMachine()
+
+	var seenBySelector, seenByLeave, seenByEnter string
+
+	sm.AddState(&State{
+		ID: "01",
+		OnLeave: func(ctx context.Context, sm *StateMachine, args ...interface{}) {
+			seenByLeave = args[0].(string)
+		},
+		Selector: func(ctx context.Context, state *State, args ...interface{}) string {
+			seenBySelector = args[0].(string)
+			return "02"
+		},
+	})
+	sm.AddState(&State{
+		ID: "02",
+		OnEnter: func(ctx context.Context, sm *StateMachine, args ...interface{}) {
+			seenByEnter = args[0].(string)
+		},
+	})
+
+	sm.Start("01", true)
+	sm.Advance("payload")
+
+	if seenBySelector != "payload" || seenByLeave != "payload" || seenByEnter != "payload" {
+		t.Fatal("expected Advance's args to reach the selector and both handlers, got",
+			seenBySelector, seenByLeave, seenByEnter)
+	}
+}
+
+func TestStateMachineClockHistoryAndSubscribe(t *testing.T) {
+	sm := NewStateMachine()
+
+	sub := sm.Subscribe()
+
+	sm.AddState(&State{
+		ID: "01",
+		Selector: LegacySelector(func(state *State) string {
+			return "02"
+		}),
+	})
+	sm.AddState(&State{
+		ID: "02",
+		Selector: LegacySelector(func(state *State) string {
+			return "01"
+		}),
+	})
+
+	sm.Start("01", true)
+	sm.Advance()
+	sm.Advance()
+	sm.Advance()
+
+	if c := sm.Clock("01"); c != 2 {
+		t.Fatal("expected 01 to have been entered twice, got", c)
+	}
+	if c := sm.Clock("02"); c != 2 {
+		t.Fatal("expected 02 to have been entered twice, got", c)
+	}
+
+	clocks := sm.Clocks()
+	if clocks["01"] != 2 || clocks["02"] != 2 {
+		t.Fatal("Clocks() snapshot does not match Clock() results:", clocks)
+	}
+
+	history := sm.History(2)
+	if len(history) != 2 {
+		t.Fatal("expected the 2 most recent transitions, got", len(history))
+	}
+	if history[0].To != "01" || history[1].To != "02" {
+		t.Fatal("unexpected transition order in history:", history)
+	}
+	for _, tr := range history {
+		if tr.Cause != CauseNormal {
+			t.Fatal("expected CauseNormal for a plain Advance, got", tr.Cause)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		select {
+		case <-sub:
+		case <-time.After(time.Second):
+			t.Fatal("subscriber did not receive all 4 transitions")
+		}
+	}
+}
+
+func TestStateMachineResultErrors(t *testing.T) {
+	sm := NewStateMachine()
+
+	sm.AddState(&State{ID: "01"})
+
+	result := sm.Start("01", true)
+	if !result.Transitioned || result.Err != nil {
+		t.Fatal("expected a clean start, got", result)
+	}
+
+	result = sm.EmergencySwitch("no-such-state", true)
+	if result.Transitioned {
+		t.Fatal("expected no transition into an unregistered state")
+	}
+	if _, ok := result.Err.(ErrNoSuchState); !ok {
+		t.Fatal("expected ErrNoSuchState, got", result.Err)
+	}
+	if sm.CurrentState() == nil || sm.CurrentState().ID != "01" {
+		t.Fatal("expected a rejected switch to leave current state untouched, got", sm.CurrentState())
+	}
+
+	sm.AddState(&State{
+		ID: "02",
+		OnEnter: LegacyStateEvent(func(sm *StateMachine) {
+			panic("boom")
+		}),
+	})
+
+	result = sm.EmergencySwitch("02", true)
+	handlerPanic, ok := result.Err.(ErrHandlerPanic)
+	if !ok {
+		t.Fatal("expected ErrHandlerPanic, got", result.Err)
+	}
+	if handlerPanic.Recovered != "boom" {
+		t.Fatal("expected the panic value to be recovered, got", handlerPanic.Recovered)
+	}
+}
+
+func TestStateMachineConcurrentAdvanceIsSerialized(t *testing.T) {
+	sm := NewStateMachine()
+
+	sm.AddState(&State{
+		ID: "01",
+		Selector: LegacySelector(func(state *State) string {
+			return "02"
+		}),
+	})
+	sm.AddState(&State{
+		ID: "02",
+		Selector: LegacySelector(func(state *State) string {
+			return "01"
+		}),
+	})
+
+	sm.Start("01", true)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sm.Advance()
+		}()
+	}
+	wg.Wait()
+
+	if c := sm.Clock("01") + sm.Clock("02"); c != 21 {
+		t.Fatal("expected every concurrent Advance to be applied exactly once, got", c)
+	}
+}
+
+func TestStateMachineStopReleasesGoroutines(t *testing.T) {
+	settle := func() int {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		return runtime.NumGoroutine()
+	}
+
+	before := settle()
+
+	machines := make([]*StateMachine, 50)
+	for i := range machines {
+		machines[i] = NewStateMachine()
+	}
+
+	if during := settle(); during < before+50 {
+		t.Fatal("expected 50 running machines to add at least 50 goroutines, got", during-before)
+	}
+
+	for _, sm := range machines {
+		sm.Stop()
+	}
+
+	if after := settle(); after > before+10 {
+		t.Fatal("expected Stop to release the dispatcher and persist writer goroutines, still running:", after-before)
+	}
+}
+
+func TestStateMachineStopCancelsStateTimeout(t *testing.T) {
+	settle := func() int {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		return runtime.NumGoroutine()
+	}
+
+	before := settle()
+
+	sm := NewStateMachine()
+	sm.AddState(&State{ID: "01", StateTimeout: time.Hour})
+	sm.Start("01", true)
+
+	if during := settle(); during < before+3 {
+		t.Fatal("expected the running machine plus its StateTimeout watchdog to add goroutines, got", during-before)
+	}
+
+	sm.Stop()
+
+	if after := settle(); after > before+1 {
+		t.Fatal("expected Stop to cancel the StateTimeout watchdog instead of leaving it running for an hour, still running:", after-before)
+	}
+}